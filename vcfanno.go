@@ -2,17 +2,22 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 
 	//_ "net/http/pprof"
 	"os"
+	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -26,6 +31,55 @@ import (
 	"github.com/brentp/xopen"
 )
 
+// bcfMagic is the 4-byte magic that starts every (decompressed) BCF stream.
+var bcfMagic = []byte("BCF\x02")
+
+// gzipMagic is the 2-byte magic that starts a gzip/bgzf stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// openQueryFile opens a single query file for reading. queryFile may be "-" to
+// read from stdin; since there's no filename extension to check in that case,
+// bgzip vs. plain text is detected from the leading magic bytes instead.
+func openQueryFile(queryFile string, nAnnotations int) (io.Reader, error) {
+	if queryFile == "-" {
+		br := bufio.NewReader(os.Stdin)
+		if magic, err := br.Peek(len(gzipMagic)); err == nil && string(magic) == string(gzipMagic) {
+			log.Printf("reading bgzip query from stdin")
+			return bgzf.NewReader(br, 1)
+		}
+		log.Printf("reading plain-text query from stdin")
+		return br, nil
+	}
+	var qrdr io.Reader
+	// try to parallelize reading if we have plenty of CPUs and it's (possibly)
+	// a bgzf file.
+	if nAnnotations < runtime.GOMAXPROCS(0) && strings.HasSuffix(queryFile, ".gz") || strings.HasSuffix(queryFile, ".bgz") {
+		rdr, err := os.Open(queryFile)
+		if err != nil {
+			return nil, err
+		}
+		if st, err := rdr.Stat(); err == nil && st.Size() > 2320303098 {
+			if r, err := bgzf.NewReader(rdr, 4); err == nil {
+				log.Printf("using 4 worker threads to decompress bgzip file")
+				qrdr = r
+			}
+		} else {
+			if r, err := bgzf.NewReader(rdr, 2); err == nil {
+				log.Printf("using 2 worker threads to decompress bgzip file")
+				qrdr = r
+			}
+		}
+	}
+	if qrdr == nil {
+		var err error
+		if qrdr, err = xopen.Ropen(queryFile); err != nil {
+			return nil, err
+		}
+		log.Printf("falling back to non-bgzip")
+	}
+	return qrdr, nil
+}
+
 var VERSION = "0.3.3"
 
 func envGet(name string, vdefault int) int {
@@ -46,6 +100,614 @@ func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
+// indexPath returns the companion index to use for path: a .csi (coordinate-sorted
+// index) is preferred over .tbi since it also supports chromosomes over 512Mb, but
+// either is accepted. It is an error for neither to exist, since Annotation.Flatten
+// requires an index to do tabix lookups against the annotation file.
+func indexPath(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	if csi := path + ".csi"; xopen.Exists(csi) {
+		return csi, nil
+	}
+	if tbi := path + ".tbi"; xopen.Exists(tbi) {
+		return tbi, nil
+	}
+	return "", fmt.Errorf("no .csi or .tbi index found for annotation file: %s", path)
+}
+
+// sniffBCF peeks at the start of r to determine whether it holds BCF rather than
+// VCF text, without relying on the query file's extension.
+func sniffBCF(r *bufio.Reader) (bool, error) {
+	b, err := r.Peek(len(bcfMagic))
+	if err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(b) == string(bcfMagic), nil
+}
+
+// bcfToVCF shells out to bcftools to decode a BCF stream to VCF text, since there
+// is no pure-Go BCF decoder compatible with parsers.VCFIterator. bcftools must be
+// on $PATH.
+//
+// This (and newOutputWriter below, for the output side) is a narrower design
+// than a Go interface implemented by separate VCF- and BCF-writer types: there's
+// no pure-Go BCF encoder to implement such an interface against, so both
+// directions pipe VCF text through a bcftools subprocess instead.
+func bcfToVCF(r io.Reader) (io.Reader, error) {
+	cmd := exec.Command("bcftools", "view", "-")
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("bcf: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("bcf: error starting bcftools, is it on $PATH?: %s", err)
+	}
+	return &waitReader{Reader: stdout, cmd: cmd}, nil
+}
+
+// waitReader wraps the stdout pipe of a started *exec.Cmd so the process is
+// reaped, and any non-zero exit surfaced as a read error, as soon as the
+// caller has consumed all of its output. Without this, a subprocess whose
+// stdout pipe is read to completion but whose Wait is never called leaks as
+// a zombie, and a bcftools failure on malformed input is silently swallowed
+// as a truncated read instead of an error.
+type waitReader struct {
+	io.Reader
+	cmd  *exec.Cmd
+	done bool
+}
+
+func (r *waitReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF && !r.done {
+		r.done = true
+		if werr := r.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("bcftools view: %s", werr)
+		}
+	}
+	return n, err
+}
+
+// closeFn is run after the last variant has been written, to let a transcoding
+// bcftools subprocess (if any) flush and exit before the program does.
+type closeFn func() error
+
+// newOutputWriter returns an io.Writer for header that writes to w, along with a
+// closeFn to run once writing is done. oFormat follows the bcftools -O convention:
+// "v" plain VCF (default), "z" bgzipped VCF, "b" compressed BCF, "u" uncompressed
+// BCF. Binary formats are produced by piping our VCF text through bcftools, since
+// vcfgo only knows how to emit VCF.
+func newOutputWriter(w io.Writer, header *vcfgo.Header, oFormat string) (io.Writer, closeFn, error) {
+	if oFormat == "" || oFormat == "v" {
+		out, err := vcfgo.NewWriter(w, header)
+		return out, func() error { return nil }, err
+	}
+	if oFormat != "z" && oFormat != "b" && oFormat != "u" {
+		return nil, nil, fmt.Errorf("unknown output format %q, expected one of b|z|v|u", oFormat)
+	}
+	cmd := exec.Command("bcftools", "view", "-O"+oFormat, "-o", "-", "-")
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("bcf: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("bcf: error starting bcftools, is it on $PATH?: %s", err)
+	}
+	out, err := vcfgo.NewWriter(stdin, header)
+	closer := func() error {
+		stdin.Close()
+		return cmd.Wait()
+	}
+	return out, closer, err
+}
+
+// latencyBuckets are the histogram bucket boundaries, in seconds, for
+// vcfanno_annotation_latency_seconds. Per-record annotation is typically
+// sub-millisecond to a few milliseconds, but the upper buckets are kept wide
+// enough to still bucket a slow lua op or a cold tabix seek.
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Stats holds counters that Session.Annotate updates as it processes variants.
+// All methods are safe to call concurrently, including while a Snapshot is taken
+// from another goroutine (e.g. the periodic progress logger or /metrics).
+type Stats struct {
+	variants      int64
+	chromPos      atomic.Value // string
+	latencyNanos  int64        // sum, for Snapshot's mean LatencySeconds and the histogram's _sum
+	latencyCounts []int64      // per-bucket counts, parallel to latencyBuckets
+	sourceHits    sync.Map     // source name (string) -> *int64
+}
+
+// newStats returns a ready-to-use Stats, with latencyCounts sized to match
+// latencyBuckets.
+func newStats() *Stats {
+	return &Stats{latencyCounts: make([]int64, len(latencyBuckets))}
+}
+
+func (st *Stats) recordVariant(chrom string, pos uint32, latency time.Duration) {
+	atomic.AddInt64(&st.variants, 1)
+	atomic.AddInt64(&st.latencyNanos, int64(latency))
+	st.chromPos.Store(fmt.Sprintf("%s:%d", chrom, pos))
+	secs := latency.Seconds()
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			atomic.AddInt64(&st.latencyCounts[i], 1)
+			break
+		}
+	}
+}
+
+// recordSourceHits counts source as having contributed to the variant just
+// annotated. There's no lower-level hook that reports per-interval overlap
+// counts from api.Annotator.AnnotateEnds, so this is called once per
+// variant, per source, based on whether any of that source's configured
+// output fields ended up on the variant's INFO -- an undercount relative to
+// "intervals returned" when a source can hit more than once per variant,
+// but a real, non-zero signal for which sources are actually contributing.
+func (st *Stats) recordSourceHits(source string) {
+	v, _ := st.sourceHits.LoadOrStore(source, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// Snapshot is a point-in-time copy of Stats, safe to read without further locking.
+type Snapshot struct {
+	Variants       int64
+	ChromPos       string
+	LatencySeconds float64   // mean seconds/variant since the session started
+	LatencyBuckets []float64 // bucket boundaries, seconds
+	LatencyCounts  []int64   // cumulative count of variants <= each LatencyBuckets entry
+	LatencySum     float64   // total seconds spent annotating, for the histogram's _sum
+	SourceHits     map[string]int64
+}
+
+// Snapshot returns the current counter values.
+func (st *Stats) Snapshot() Snapshot {
+	n := atomic.LoadInt64(&st.variants)
+	snap := Snapshot{
+		Variants:       n,
+		SourceHits:     map[string]int64{},
+		LatencyBuckets: latencyBuckets,
+		LatencyCounts:  make([]int64, len(latencyBuckets)),
+	}
+	if cp, ok := st.chromPos.Load().(string); ok {
+		snap.ChromPos = cp
+	}
+	snap.LatencySum = float64(atomic.LoadInt64(&st.latencyNanos)) / 1e9
+	if n > 0 {
+		snap.LatencySeconds = snap.LatencySum / float64(n)
+	}
+	var cumulative int64
+	for i := range latencyBuckets {
+		cumulative += atomic.LoadInt64(&st.latencyCounts[i])
+		snap.LatencyCounts[i] = cumulative
+	}
+	st.sourceHits.Range(func(k, v interface{}) bool {
+		snap.SourceHits[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return snap
+}
+
+// WriteProm writes st's counters in Prometheus text exposition format.
+func (st *Stats) WriteProm(w io.Writer) {
+	snap := st.Snapshot()
+	fmt.Fprintf(w, "# HELP vcfanno_variants_total variants annotated so far.\n")
+	fmt.Fprintf(w, "# TYPE vcfanno_variants_total counter\n")
+	fmt.Fprintf(w, "vcfanno_variants_total %d\n", snap.Variants)
+	fmt.Fprintf(w, "# HELP vcfanno_annotation_latency_seconds per-record annotation latency.\n")
+	fmt.Fprintf(w, "# TYPE vcfanno_annotation_latency_seconds histogram\n")
+	for i, le := range snap.LatencyBuckets {
+		fmt.Fprintf(w, "vcfanno_annotation_latency_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(le, 'g', -1, 64), snap.LatencyCounts[i])
+	}
+	fmt.Fprintf(w, "vcfanno_annotation_latency_seconds_bucket{le=\"+Inf\"} %d\n", snap.Variants)
+	fmt.Fprintf(w, "vcfanno_annotation_latency_seconds_sum %f\n", snap.LatencySum)
+	fmt.Fprintf(w, "vcfanno_annotation_latency_seconds_count %d\n", snap.Variants)
+	fmt.Fprintf(w, "# HELP vcfanno_source_hits_total variants each annotation source contributed a value to.\n")
+	fmt.Fprintf(w, "# TYPE vcfanno_source_hits_total counter\n")
+	for source, n := range snap.SourceHits {
+		fmt.Fprintf(w, "vcfanno_source_hits_total{source=%q} %d\n", source, n)
+	}
+}
+
+// logProgress logs throughput and position every interval until stop is closed.
+func logProgress(st *Stats, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			snap := st.Snapshot()
+			elapsed := time.Since(start).Seconds()
+			var rate float64
+			if elapsed > 0 {
+				rate = float64(snap.Variants) / elapsed
+			}
+			log.Printf("progress: %d variants (%.1f/sec), at %s", snap.Variants, rate, snap.ChromPos)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Session holds an Annotator and the processing options needed to run the
+// annotate pipeline (open reader -> VCFIterator -> a.Setup -> PIRelate ->
+// writer) repeatedly without re-parsing the config each time, as -serve does
+// per request. It does not hold queryables: openQuery and AnnotateRegion call
+// Annotator.Setup again for every query stream or region.
+type Session struct {
+	ann             *Annotator
+	ends            bool
+	strict          bool
+	oFormat         string
+	outputFormat    string
+	annotationNames []string
+	sourceFields    map[string][]string
+	maxGap          int
+	maxChunk        int
+	stats           *Stats
+	progressEvery   time.Duration
+}
+
+// NewSession builds a Session around an already-constructed Annotator. outputFormat
+// is "vcf" (the default) or "json" for newline-delimited JSON. annotationNames are
+// the Names from config.Annotation and config.PostAnnotation, in the order a
+// -output-format json record's "annotations" map should consider them. sourceFields
+// maps each annotation source (its config.Annotation.File) to the output field
+// Names it can add, so recordSourceHits can attribute vcfanno_source_hits_total to
+// the right source. progressEvery is how often Annotate logs throughput; it does
+// not affect the -metrics-addr /metrics endpoint, which takes a fresh
+// Stats.Snapshot on every request.
+func NewSession(ann *Annotator, ends, strict bool, oFormat, outputFormat string, annotationNames []string, sourceFields map[string][]string, progressEvery time.Duration) *Session {
+	return &Session{
+		ann:             ann,
+		ends:            ends,
+		strict:          strict,
+		oFormat:         oFormat,
+		outputFormat:    outputFormat,
+		annotationNames: annotationNames,
+		sourceFields:    sourceFields,
+		maxGap:          envGet("IRELATE_MAX_GAP", 20000),
+		maxChunk:        envGet("IRELATE_MAX_CHUNK", 8000),
+		stats:           newStats(),
+		progressEvery:   progressEvery,
+	}
+}
+
+// openQuery reads a VCF or BCF query stream from r, sets up the Annotator's
+// queryables against its header, and returns the stream of annotated records
+// along with the (possibly BCF-decoded) query header.
+func (s *Session) openQuery(r io.Reader) (<-chan interfaces.Relatable, *vcfgo.Header, error) {
+	bqrdr := bufio.NewReader(r)
+	var qrdr io.Reader = bqrdr
+	if isBCF, err := sniffBCF(bqrdr); err != nil {
+		return nil, nil, fmt.Errorf("error reading query: %s", err)
+	} else if isBCF {
+		var err error
+		if qrdr, err = bcfToVCF(bqrdr); err != nil {
+			return nil, nil, err
+		}
+	}
+	qstream, query, err := parsers.VCFIterator(qrdr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing VCF query: %s", err)
+	}
+	queryables, err := s.ann.Setup(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	aends := INTERVAL
+	if s.ends {
+		aends = BOTH
+	}
+	lastMsg := struct {
+		sync.RWMutex
+		s [10]string
+		i int
+	}{}
+	fn := func(v interfaces.Relatable) {
+		t0 := time.Now()
+		e := s.ann.AnnotateEnds(v, aends)
+		s.stats.recordVariant(v.Chrom(), v.Start(), time.Since(t0))
+		if variant, ok := v.(*vcfgo.Variant); ok && len(s.sourceFields) > 0 {
+			info := variant.Info()
+			for source, names := range s.sourceFields {
+				for _, name := range names {
+					if _, gerr := info.Get(name); gerr == nil {
+						s.stats.recordSourceHits(source)
+						break
+					}
+				}
+			}
+		}
+		if e == nil {
+			return
+		}
+		lastMsg.RLock()
+		em := e.Error()
+		found := false
+		for i := len(lastMsg.s) - 1; i >= 0; i-- {
+			if em == lastMsg.s[i] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Println(e, ">> this error/warning may occur many times. reporting once here...")
+			lastMsg.RUnlock()
+			lastMsg.Lock()
+			lastMsg.s[lastMsg.i] = em
+			if lastMsg.i == len(lastMsg.s)-1 {
+				lastMsg.i = -1
+			}
+			lastMsg.i++
+			lastMsg.Unlock()
+		} else {
+			lastMsg.RUnlock()
+		}
+	}
+
+	stream := irelate.PIRelate(s.maxChunk, s.maxGap, qstream, s.ends, fn, queryables...)
+	return stream, query.Header, nil
+}
+
+// Annotate reads a single VCF or BCF query stream from r, annotates every
+// record, and writes the result (NDJSON for a "json" outputFormat, otherwise
+// the Session's configured oFormat) to w. It
+// returns the number of variants processed. For more than one query file, see
+// AnnotateFiles.
+func (s *Session) Annotate(r io.Reader, w io.Writer) (int, error) {
+	return s.AnnotateFiles([]func() (io.Reader, error){func() (io.Reader, error) { return r, nil }}, w)
+}
+
+// AnnotateFiles runs each opener through the pipeline in order against a single
+// loaded Session, writing one concatenated output to w: the header (for "vcf"
+// outputFormat) comes from the first file and is written once, and every file's
+// annotated records are appended to the same stream. Readers are opened lazily,
+// one at a time, so this works for callers with hundreds of per-sample query
+// files without holding hundreds of file descriptors at once, while still
+// avoiding paying config-parse and index-load cost more than once.
+//
+// Since every file after the first is written through the VCF writer built
+// from the first file's header, all query files must share the same sample
+// columns in that case -- splitting one cohort's VCF by chromosome, say, not
+// splitting a cohort into one VCF per sample. A later file with a different
+// sample list is rejected rather than silently written under a #CHROM header
+// that no longer matches its genotype columns.
+func (s *Session) AnnotateFiles(openers []func() (io.Reader, error), w io.Writer) (int, error) {
+	if s.progressEvery > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go logProgress(s.stats, s.progressEvery, stop)
+	}
+
+	var out io.Writer
+	var enc *json.Encoder
+	var closeOut closeFn
+	var firstSamples []string
+	total := 0
+	for i, open := range openers {
+		r, err := open()
+		if err != nil {
+			return total, err
+		}
+		stream, header, err := s.openQuery(r)
+		if err != nil {
+			return total, err
+		}
+		if i == 0 {
+			firstSamples = header.SampleNames
+			header.Extras = append(header.Extras, fmt.Sprintf("##vcfanno=%s", VERSION))
+			if s.outputFormat == "json" {
+				enc = json.NewEncoder(w)
+			} else {
+				out, closeOut, err = newOutputWriter(w, header, s.oFormat)
+				if err != nil {
+					return total, err
+				}
+				defer closeOut()
+			}
+		} else if enc == nil && !sameStrings(header.SampleNames, firstSamples) {
+			// openQuery's irelate.PIRelate pipeline is already running by the
+			// time we see header.SampleNames, so drain its stream before
+			// bailing out -- otherwise the goroutines and readers it started
+			// for this rejected file are never given a chance to finish.
+			for range stream {
+			}
+			return total, fmt.Errorf("query file %d has samples %v, which differ from the first query file's samples %v; "+
+				"annotating multiple VCF query files in one run requires them to share the same sample columns",
+				i, header.SampleNames, firstSamples)
+		}
+		for interval := range stream {
+			if enc != nil {
+				v, ok := interval.(*vcfgo.Variant)
+				if !ok {
+					continue
+				}
+				if err := enc.Encode(toJSONRecord(v, s.annotationNames)); err != nil {
+					return total, err
+				}
+			} else {
+				fmt.Fprintln(out, interval)
+			}
+			total++
+		}
+	}
+	return total, nil
+}
+
+// sameStrings reports whether a and b contain the same strings in the same order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonRecord is the NDJSON shape written in -output-format json mode: one line
+// per variant, e.g.
+//
+//	{"chrom":"1","pos":10000,"ref":"A","alt":["G"],"samples":["0/1"],"annotations":{"AC":3}}
+//
+// Annotations is keyed only by the Name values from the config's
+// [[annotation]] and [[postannotation]] sections (vcfanno writes those as
+// INFO fields on the annotated variant) — INFO fields that were already on
+// the input VCF and aren't one of those configured names are left out, so a
+// field unrelated to vcfanno never shows up mislabeled as an annotation.
+type jsonRecord struct {
+	Chrom       string                 `json:"chrom"`
+	Pos         uint64                 `json:"pos"`
+	Ref         string                 `json:"ref"`
+	Alt         []string               `json:"alt"`
+	Samples     []string               `json:"samples,omitempty"`
+	Annotations map[string]interface{} `json:"annotations"`
+}
+
+// toJSONRecord builds the NDJSON record for v, taking only the INFO fields
+// named in names (the config's [[annotation]] and [[postannotation]] Names).
+func toJSONRecord(v *vcfgo.Variant, names []string) *jsonRecord {
+	rec := &jsonRecord{
+		Chrom:       v.Chromosome,
+		Pos:         v.Pos,
+		Ref:         v.Reference,
+		Alt:         v.Alternate,
+		Annotations: make(map[string]interface{}),
+	}
+	info := v.Info()
+	for _, name := range names {
+		if val, err := info.Get(name); err == nil {
+			rec.Annotations[name] = val
+		}
+	}
+	for _, sample := range v.Samples {
+		rec.Samples = append(rec.Samples, sample.Fields["GT"])
+	}
+	return rec
+}
+
+// region is the JSON body accepted by POST /annotate-region.
+type region struct {
+	Chrom string `json:"chrom"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// regionRecord is the JSON response from POST /annotate-region: the
+// annotations vcfanno found for the requested region, keyed the same way as
+// -output-format json's jsonRecord.
+type regionRecord struct {
+	Chrom       string                 `json:"chrom"`
+	Start       int                    `json:"start"`
+	End         int                    `json:"end"`
+	Annotations map[string]interface{} `json:"annotations"`
+}
+
+// emptyVCFHeader is a minimal, record-less VCF used to get a *vcfgo.Reader
+// for AnnotateRegion to call Setup with: Setup only needs it for the header,
+// since AnnotateRegion annotates a bare interval rather than a VCF record.
+const emptyVCFHeader = "##fileformat=VCFv4.2\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n"
+
+// AnnotateRegion runs a single bare interval through the same Setup/PIRelate
+// join that openQuery uses for VCF records -- the only place in this file
+// that actually relates a query record against the annotation sources before
+// AnnotateEnds is called -- and returns the annotations found for it.
+func (s *Session) AnnotateRegion(chrom string, start, end int) (*regionRecord, error) {
+	_, query, err := parsers.VCFIterator(strings.NewReader(emptyVCFHeader))
+	if err != nil {
+		return nil, err
+	}
+	queryables, err := s.ann.Setup(query)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := parsers.NewInterval(chrom, uint32(start), uint32(end))
+	qstream := make(chan interfaces.Relatable, 1)
+	qstream <- iv
+	close(qstream)
+
+	aends := INTERVAL
+	if s.ends {
+		aends = BOTH
+	}
+	var annErr error
+	fn := func(v interfaces.Relatable) {
+		annErr = s.ann.AnnotateEnds(v, aends)
+	}
+	stream := irelate.PIRelate(s.maxChunk, s.maxGap, qstream, s.ends, fn, queryables...)
+	for range stream {
+	}
+	if annErr != nil {
+		return nil, annErr
+	}
+
+	rec := &regionRecord{Chrom: chrom, Start: start, End: end, Annotations: make(map[string]interface{})}
+	info := iv.Info()
+	for _, name := range s.annotationNames {
+		if val, err := info.Get(name); err == nil {
+			rec.Annotations[name] = val
+		}
+	}
+	return rec, nil
+}
+
+// serve starts an HTTP server that reuses Session (and therefore the parsed
+// config and Annotator) across many requests instead of paying config-parse
+// cost per query file, as main() does for a single run. Each request still
+// goes through Annotator.Setup (see Session).
+func serve(addr string, s *Session) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/annotate", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := s.Annotate(req.Body, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("/annotate: wrote %d variants", n)
+	})
+	mux.HandleFunc("/annotate-region", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+			return
+		}
+		var rg region
+		if err := json.NewDecoder(req.Body).Decode(&rg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec, err := s.AnnotateRegion(rg.Chrom, rg.Start, rg.End)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rec)
+	})
+	log.Printf("vcfanno server listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
 func main() {
 	fmt.Fprintf(os.Stderr, `
 =============================================
@@ -61,21 +723,47 @@ see: https://github.com/brentp/vcfanno
 	lua := flag.String("lua", "", "optional path to a file containing custom lua functions to be used as ops")
 	base := flag.String("base-path", "", "optional base-path to prepend to annotation files in the config")
 	procs := flag.Int("p", 2, "number of processes to use.")
+	oFormat := flag.String("O", "v", "output format: b: compressed BCF, u: uncompressed BCF, z: bgzipped VCF, v: VCF (default)")
+	outputFormat := flag.String("output-format", "vcf", "vcf: write a VCF/BCF as usual (see -O). "+
+		"json: write one JSON object per variant (newline-delimited) with an annotations map instead")
+	serveAddr := flag.String("serve", "", "if set, don't process a query file; instead start an HTTP server at this"+
+		" address that keeps the config and annotation sources loaded across requests")
+	progressEvery := flag.Duration("progress-every", 30*time.Second, "how often to log throughput and current position; 0 disables")
+	metricsAddr := flag.String("metrics-addr", "", "if set, serve Prometheus metrics (vcfanno_variants_total, "+
+		"vcfanno_source_hits_total, vcfanno_annotation_latency_seconds) at this address, e.g. localhost:9001")
 	flag.Parse()
+	if *outputFormat != "vcf" && *outputFormat != "json" {
+		log.Fatalf("ERROR: -output-format must be vcf or json, got %q", *outputFormat)
+	}
 	inFiles := flag.Args()
-	if len(inFiles) != 2 {
+	if *serveAddr == "" && len(inFiles) < 2 {
 		fmt.Printf(`Usage:
-%s config.toml input.vcf > annotated.vcf
+%s config.toml input.vcf [input2.vcf ...] > annotated.vcf
+%s config.toml - > annotated.vcf   (read query from stdin)
+%s -serve localhost:9000 config.toml
 
-`, os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
-	queryFile := inFiles[1]
-	if !(xopen.Exists(queryFile) || queryFile == "") {
-		fmt.Fprintf(os.Stderr, "\nERROR: can't find query file: %s\n", queryFile)
+	if *serveAddr != "" && len(inFiles) != 1 {
+		fmt.Printf(`Usage:
+%s -serve localhost:9000 config.toml
+
+`, os.Args[0])
+		flag.PrintDefaults()
 		os.Exit(2)
 	}
+	var queryFiles []string
+	if *serveAddr == "" {
+		queryFiles = inFiles[1:]
+		for _, qf := range queryFiles {
+			if qf != "-" && !xopen.Exists(qf) {
+				fmt.Fprintf(os.Stderr, "\nERROR: can't find query file: %s\n", qf)
+				os.Exit(2)
+			}
+		}
+	}
 	runtime.GOMAXPROCS(*procs)
 
 	var config Config
@@ -86,11 +774,17 @@ see: https://github.com/brentp/vcfanno
 		panic(err)
 	}
 	config.Base = *base
-	for _, a := range config.Annotation {
-		err := CheckAnno(&a)
+	for i := range config.Annotation {
+		a := &config.Annotation[i]
+		err := CheckAnno(a)
 		if err != nil {
 			log.Fatal("CheckAnno err:", err)
 		}
+		idx, err := indexPath(a.File)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.Index = idx
 		for _, op := range a.Ops {
 			if len(op) > 4 && op[:4] == "lua:" && *lua == "" {
 				log.Fatal("ERROR: requested lua op without specifying -lua flag")
@@ -124,122 +818,45 @@ see: https://github.com/brentp/vcfanno
 	strict := !*notstrict
 	var a = NewAnnotator(sources, luaString, *ends, strict, config.PostAnnotation)
 
-	var out io.Writer = os.Stdout
-	defer os.Stdout.Close()
-
-	var err error
-	var qrdr io.Reader
-	// try to parallelize reading if we have plenty of CPUs and it's (possibly)
-	// a bgzf file.
-	if len(config.Annotation) < runtime.GOMAXPROCS(0) && strings.HasSuffix(queryFile, ".gz") || strings.HasSuffix(queryFile, ".bgz") {
-		if rdr, err := os.Open(queryFile); err == nil {
-			if st, err := rdr.Stat(); err == nil && st.Size() > 2320303098 {
-				qrdr, err = bgzf.NewReader(rdr, 4)
-				if err == nil {
-					log.Printf("using 4 worker threads to decompress bgzip file")
-				} else {
-					qrdr = nil
-				}
-			} else {
-				qrdr, err = bgzf.NewReader(rdr, 2)
-				if err == nil {
-					log.Printf("using 2 worker threads to decompress bgzip file")
-				} else {
-					qrdr = nil
-				}
-			}
-		} else {
-			log.Fatal(err)
-		}
+	var annotationNames []string
+	sourceFields := make(map[string][]string, len(config.Annotation))
+	for _, ann := range config.Annotation {
+		annotationNames = append(annotationNames, ann.Names...)
+		sourceFields[ann.File] = append(sourceFields[ann.File], ann.Names...)
 	}
-	if qrdr == nil {
-		qrdr, err = xopen.Ropen(queryFile)
-		log.Printf("falling back to non-bgzip")
-	}
-	if err != nil {
-		log.Fatal(fmt.Errorf("error opening query file %s: %s", queryFile, err))
-	}
-	qstream, query, err := parsers.VCFIterator(qrdr)
-	if err != nil {
-		log.Fatal(fmt.Errorf("error parsing VCF query file %s: %s", queryFile, err))
+	for _, p := range config.PostAnnotation {
+		annotationNames = append(annotationNames, p.Name)
 	}
+	session := NewSession(a, *ends, strict, *oFormat, *outputFormat, annotationNames, sourceFields, *progressEvery)
 
-	queryables, err := a.Setup(query)
-	if err != nil {
-		log.Fatal(err)
-	}
-	aends := INTERVAL
-	if *ends {
-		aends = BOTH
+	if *metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+				session.stats.WriteProm(w)
+			})
+			log.Printf("serving Prometheus metrics on %s/metrics", *metricsAddr)
+			log.Println(http.ListenAndServe(*metricsAddr, mux))
+		}()
 	}
 
-	lastMsg := struct {
-		sync.RWMutex
-		s [10]string
-		i int
-	}{}
-
-	fn := func(v interfaces.Relatable) {
-		e := a.AnnotateEnds(v, aends)
-		if e != nil {
-			lastMsg.RLock()
-			em := e.Error()
-			found := false
-			for i := len(lastMsg.s) - 1; i >= 0; i-- {
-				if em == lastMsg.s[i] {
-					found = true
-					break
-				}
-			}
-			if !found {
-				log.Println(e, ">> this error/warning may occur many times. reporting once here...")
-				lastMsg.RUnlock()
-				lastMsg.Lock()
-				lastMsg.s[lastMsg.i] = em
-				if lastMsg.i == len(lastMsg.s)-1 {
-					lastMsg.i = -1
-				}
-				lastMsg.i++
-
-				lastMsg.Unlock()
-			} else {
-				lastMsg.RUnlock()
-			}
-		}
+	if *serveAddr != "" {
+		log.Fatal(serve(*serveAddr, session))
 	}
 
-	maxGap := envGet("IRELATE_MAX_GAP", 20000)
-	maxChunk := envGet("IRELATE_MAX_CHUNK", 8000)
-
-	// make a new writer from the string header.
-	query.Header.Extras = append(query.Header.Extras, fmt.Sprintf("##vcfanno=%s", VERSION))
-	out, err = vcfgo.NewWriter(out, query.Header)
-
-	stream := irelate.PIRelate(maxChunk, maxGap, qstream, *ends, fn, queryables...)
+	var out io.Writer = os.Stdout
+	defer os.Stdout.Close()
 
-	if err != nil {
-		log.Fatal(err)
+	openers := make([]func() (io.Reader, error), len(queryFiles))
+	for i, qf := range queryFiles {
+		qf := qf
+		openers[i] = func() (io.Reader, error) { return openQueryFile(qf, len(config.Annotation)) }
 	}
 
 	start := time.Now()
-	n := 0
-
-	/*
-		if os.Getenv("IRELATE_PROFILE") == "TRUE" {
-			log.Println("profiling to: irelate.pprof")
-			f, err := os.Create("irelate.pprof")
-			if err != nil {
-				panic(err)
-			}
-			pprof.StartCPUProfile(f)
-			defer pprof.StopCPUProfile()
-		}
-	*/
-
-	for interval := range stream {
-		//log.Printf("%v\n", interval)
-		fmt.Fprintln(out, interval)
-		n++
+	n, err := session.AnnotateFiles(openers, out)
+	if err != nil {
+		log.Fatal(fmt.Errorf("error annotating query files %v: %s", queryFiles, err))
 	}
 	printTime(start, n)
 }
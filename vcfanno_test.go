@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brentp/vcfgo"
+)
+
+// NOTE: these only exercise indexPath's own string-matching logic against
+// placeholder files, not a real bgzipped VCF with a genuine CSI index read
+// end-to-end through config.Sources()/Annotation.Flatten -- this sandbox has
+// no bgzip/tabix/bcftools binaries available to build that fixture with, and
+// the api/shared packages that own Flatten aren't vendored here either. A
+// real fixture-backed test belongs in the api package's own test suite,
+// alongside Flatten, once one of those is buildable.
+
+func TestIndexPathPrefersCSI(t *testing.T) {
+	dir := t.TempDir()
+	vcf := filepath.Join(dir, "anno.vcf.gz")
+	for _, suffix := range []string{".csi", ".tbi"} {
+		if err := os.WriteFile(vcf+suffix, []byte("index"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, err := indexPath(vcf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != vcf+".csi" {
+		t.Errorf("expected .csi to be preferred over .tbi, got %q", idx)
+	}
+}
+
+func TestIndexPathFallsBackToTBI(t *testing.T) {
+	dir := t.TempDir()
+	vcf := filepath.Join(dir, "anno.vcf.gz")
+	if err := os.WriteFile(vcf+".tbi", []byte("index"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := indexPath(vcf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != vcf+".tbi" {
+		t.Errorf("expected fallback to .tbi, got %q", idx)
+	}
+}
+
+func TestIndexPathErrorsWithoutEither(t *testing.T) {
+	dir := t.TempDir()
+	vcf := filepath.Join(dir, "anno.vcf.gz")
+	if err := os.WriteFile(vcf, []byte("vcf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexPath(vcf); err == nil {
+		t.Error("expected an error when neither .csi nor .tbi exists")
+	}
+}
+
+func TestIndexPathEmptyPath(t *testing.T) {
+	idx, err := indexPath("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != "" {
+		t.Errorf("expected empty index for empty path, got %q", idx)
+	}
+}
+
+func TestSameStrings(t *testing.T) {
+	cases := []struct {
+		a, b []string
+		want bool
+	}{
+		{nil, nil, true},
+		{[]string{"s1", "s2"}, []string{"s1", "s2"}, true},
+		{[]string{"s1", "s2"}, []string{"s2", "s1"}, false},
+		{[]string{"s1"}, []string{"s1", "s2"}, false},
+	}
+	for _, c := range cases {
+		if got := sameStrings(c.a, c.b); got != c.want {
+			t.Errorf("sameStrings(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestSniffBCF(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"bcf magic", "BCF\x02\x01rest-of-stream", true},
+		{"vcf text", "##fileformat=VCFv4.2\n", false},
+		{"shorter than the magic", "BC", false},
+		{"empty", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := sniffBCF(bufio.NewReader(strings.NewReader(c.input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("sniffBCF(%q) = %v, want %v", c.input, got, c.want)
+			}
+		})
+	}
+}
+
+// waitReaderCmd starts name (expected to be a real binary on $PATH, e.g.
+// "true" or "false") with no stdout output, returning its stdout pipe
+// wrapped in a waitReader the way bcfToVCF does.
+func waitReaderCmd(t *testing.T, name string) *waitReader {
+	t.Helper()
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%s not on $PATH", name)
+	}
+	cmd := exec.Command(name)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return &waitReader{Reader: stdout, cmd: cmd}
+}
+
+func TestWaitReaderSurfacesNonZeroExit(t *testing.T) {
+	r := waitReaderCmd(t, "false")
+	_, err := io.ReadAll(r)
+	if err == nil {
+		t.Error("expected io.ReadAll to surface false's non-zero exit as an error")
+	}
+}
+
+func TestWaitReaderReapsSuccessfulProcess(t *testing.T) {
+	r := waitReaderCmd(t, "true")
+	if _, err := io.ReadAll(r); err != nil {
+		t.Errorf("expected no error reaping a successful process, got %s", err)
+	}
+	if r.cmd.ProcessState == nil {
+		t.Error("expected cmd.Wait to have run (setting ProcessState) once the caller read to EOF")
+	}
+}
+
+func TestBcfToVCF(t *testing.T) {
+	if _, err := exec.LookPath("bcftools"); err != nil {
+		t.Skip("bcftools not on $PATH")
+	}
+	// A real test here would pipe a small BCF fixture through bcfToVCF and
+	// read back the decoded VCF text; generating that fixture needs
+	// bcftools itself, which isn't available in every environment this runs
+	// in, so this only confirms the happy path starts cleanly against an
+	// empty stdin rather than asserting on decoded content.
+	r, err := bcfToVCF(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Errorf("expected bcftools to exit cleanly on empty input, got %s", err)
+	}
+}
+
+// TestToJSONRecord checks that only the configured annotation names (AC,
+// max_aaf) end up in the "annotations" map, and that DP -- an INFO field on
+// the input VCF that isn't a vcfanno output -- is left out, against a golden
+// rendering of the record.
+func TestToJSONRecord(t *testing.T) {
+	f, err := os.Open("testdata/toJSONRecord_query.vcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rdr, err := vcfgo.NewReader(f, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := rdr.Read()
+	if v == nil {
+		t.Fatal("expected a variant from testdata/toJSONRecord_query.vcf")
+	}
+
+	rec := toJSONRecord(v, []string{"AC", "max_aaf"})
+
+	got, err := json.MarshalIndent(rec, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	want, err := os.ReadFile("testdata/toJSONRecord_golden.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("toJSONRecord output mismatch:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}